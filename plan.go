@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// StepKind identifies the action a Step performs within a Plan.
+type StepKind string
+
+const (
+	StepInitKube StepKind = "init_kube"
+	StepHelmInit StepKind = "helm_init"
+	StepAddRepo  StepKind = "add_repo"
+	StepLint     StepKind = "lint"
+	StepUpgrade  StepKind = "upgrade"
+	StepDelete   StepKind = "delete"
+	StepRollback StepKind = "rollback"
+)
+
+// Step is a single, independently runnable unit of a Plan.
+type Step struct {
+	Kind StepKind
+	Run  func(p *Plugin, stdout, stderr io.Writer) error
+}
+
+// Plan is the ordered sequence of Steps required to satisfy a Config.
+type Plan struct {
+	Config Config
+	Steps  []Step
+}
+
+// NewPlan validates cfg and assembles the Steps needed to carry it out.
+// Building the Plan is side-effect free: nothing is executed until
+// Plan.Execute is called.
+func NewPlan(cfg Config) (*Plan, error) {
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Config: cfg}
+	p := &Plugin{Config: cfg}
+
+	if _, err := os.Stat(cfg.KubeConfig); os.IsNotExist(err) {
+		plan.Steps = append(plan.Steps, Step{Kind: StepInitKube, Run: stepInitKube})
+	}
+
+	if !isHelm3(p) && !isSDKBackend(p) {
+		plan.Steps = append(plan.Steps, Step{Kind: StepHelmInit, Run: stepHelmInit})
+	}
+
+	for _, repo := range cfg.HelmRepos {
+		repo := repo
+		plan.Steps = append(plan.Steps, Step{
+			Kind: StepAddRepo,
+			Run: func(p *Plugin, stdout, stderr io.Writer) error {
+				return stepAddRepo(p, repo, stdout, stderr)
+			},
+		})
+	}
+
+	switch helmAction(p) {
+	case "delete":
+		plan.Steps = append(plan.Steps, Step{Kind: StepDelete, Run: stepHelmCommand})
+	case "lint":
+		plan.Steps = append(plan.Steps, Step{Kind: StepLint, Run: stepHelmCommand})
+	case "rollback":
+		plan.Steps = append(plan.Steps, Step{Kind: StepRollback, Run: stepHelmCommand})
+	default:
+		plan.Steps = append(plan.Steps, Step{Kind: StepUpgrade, Run: stepHelmCommand})
+	}
+
+	return plan, nil
+}
+
+// validateConfig rejects Configs that Plan has no way to carry out.
+func validateConfig(cfg Config) error {
+	switch cfg.HelmVersion {
+	case "", "2", "3":
+	default:
+		return fmt.Errorf("Error: unsupported helm_version: %s", cfg.HelmVersion)
+	}
+
+	switch cfg.Backend {
+	case "", "exec", "sdk":
+	default:
+		return fmt.Errorf("Error: unsupported backend: %s", cfg.Backend)
+	}
+
+	return nil
+}
+
+// Execute runs every Step in order with the given IO, stopping at the
+// first error.
+func (pl *Plan) Execute(stdout, stderr io.Writer) error {
+	p := &Plugin{Config: pl.Config}
+	for _, step := range pl.Steps {
+		if err := step.Run(p, stdout, stderr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stepInitKube(p *Plugin, stdout, stderr io.Writer) error {
+	resolveSecrets(p)
+	if p.Config.APIServer == "" {
+		return fmt.Errorf("Error: API Server is needed to deploy.")
+	}
+	if p.Config.Token == "" {
+		return fmt.Errorf("Error: Token is needed to deploy.")
+	}
+
+	return initialiseKubeconfig(&p.Config, KUBECONFIG, p.Config.KubeConfig)
+}
+
+func stepHelmInit(p *Plugin, stdout, stderr io.Writer) error {
+	init := doHelmInit(p)
+	if init == nil {
+		return nil
+	}
+
+	if err := runCommand(p, init, stdout, stderr); err != nil {
+		return fmt.Errorf("Error running helm command: " + strings.Join(init, " "))
+	}
+	return nil
+}
+
+func stepAddRepo(p *Plugin, repo string, stdout, stderr io.Writer) error {
+	if isSDKBackend(p) {
+		return sdkAddRepo(p, repo)
+	}
+
+	repoAdd, err := doHelmRepoAdd(repo, p)
+	if err != nil {
+		return err
+	}
+
+	if p.Config.Debug {
+		log.Println("adding helm repo: " + strings.Join(repoAdd, " "))
+	}
+
+	if err := runCommand(p, repoAdd, stdout, stderr); err != nil {
+		return fmt.Errorf("Error adding helm repo: " + err.Error())
+	}
+	return nil
+}
+
+func stepHelmCommand(p *Plugin, stdout, stderr io.Writer) error {
+	action := helmAction(p)
+
+	if isSDKBackend(p) {
+		return sdkHelmCommand(p, action, stdout, stderr)
+	}
+
+	setHelmCommand(p)
+
+	if p.Config.Debug {
+		log.Println("helm command: " + strings.Join(p.Config.HelmCommand, " "))
+	}
+
+	switch action {
+	case "upgrade":
+		return runUpgradeStep(p, stdout, stderr)
+	case "rollback":
+		return runRollbackStep(p, stdout, stderr)
+	}
+
+	if err := runCommand(p, p.Config.HelmCommand, stdout, stderr); err != nil {
+		return fmt.Errorf("Error running helm command: " + strings.Join(p.Config.HelmCommand, " "))
+	}
+	return nil
+}
+
+// sdkHelmCommand dispatches action to the SDK backend. Auto-rollback on a
+// failed upgrade is handled the same way as the exec backend, just with
+// sdkRollback instead of shelling out.
+func sdkHelmCommand(p *Plugin, action string, stdout, stderr io.Writer) error {
+	switch action {
+	case "lint":
+		return sdkLint(p)
+	case "delete":
+		return sdkDelete(p)
+	case "rollback":
+		revision := 0
+		if p.Config.Revision != "" {
+			fmt.Sscanf(p.Config.Revision, "%d", &revision)
+		}
+		info, err := sdkRollback(p, revision)
+		if err != nil {
+			return err
+		}
+		return writeSDKStatus(p, info, stdout)
+	default:
+		info, err := sdkUpgrade(context.Background(), p)
+		if err != nil {
+			if p.Config.AutoRollback {
+				if _, rbErr := sdkRollback(p, 0); rbErr != nil {
+					return fmt.Errorf("Error running helm upgrade: %s (automatic rollback also failed: %s)", err.Error(), rbErr.Error())
+				}
+				return fmt.Errorf("Error running helm upgrade: %s", err.Error())
+			}
+			return fmt.Errorf("Error running helm upgrade: %s", err.Error())
+		}
+		return writeSDKStatus(p, info, stdout)
+	}
+}
+
+// runUpgradeStep runs the upgrade, parses the release status out of its
+// --output json, and persists it to status_output_file. Failure is keyed
+// off Info.Status (case-insensitively -- Helm 2 reports "DEPLOYED", Helm 3
+// reports "deployed") rather than only helm's exit code, since helm can
+// exit 0 for a release that never reached "deployed".
+func runUpgradeStep(p *Plugin, stdout, stderr io.Writer) error {
+	output, runErr := runCommandCapture(p, p.Config.HelmCommand, stdout, stderr)
+
+	info, parseErr := parseReleaseInfo(output)
+	if parseErr == nil {
+		if err := writeReleaseInfo(p.Config.StatusOutputFile, info); err != nil {
+			log.Println("could not write status_output_file: " + err.Error())
+		}
+	}
+
+	cmdErr := runErr
+	if cmdErr == nil && info != nil && info.Status != "" && !strings.EqualFold(info.Status, "deployed") {
+		cmdErr = fmt.Errorf("Error: release %s ended in status %q", p.Config.Release, info.Status)
+	}
+	if cmdErr == nil {
+		return nil
+	}
+
+	if p.Config.AutoRollback {
+		return autoRollback(p, cmdErr, stdout, stderr)
+	}
+
+	return fmt.Errorf("Error running helm command: %s (%s)", strings.Join(p.Config.HelmCommand, " "), cmdErr.Error())
+}
+
+// runRollbackStep runs the rollback and then looks up the resulting
+// release status separately via `helm status`, since `helm rollback`
+// itself has no --output flag to emit it directly.
+func runRollbackStep(p *Plugin, stdout, stderr io.Writer) error {
+	if err := runCommand(p, p.Config.HelmCommand, stdout, stderr); err != nil {
+		return fmt.Errorf("Error running helm command: " + strings.Join(p.Config.HelmCommand, " "))
+	}
+
+	info, err := fetchReleaseStatus(p, stderr)
+	if err != nil {
+		log.Println("could not determine release status after rollback: " + err.Error())
+		return nil
+	}
+
+	if err := writeReleaseInfo(p.Config.StatusOutputFile, info); err != nil {
+		log.Println("could not write status_output_file: " + err.Error())
+	}
+
+	if info.Status != "" && !strings.EqualFold(info.Status, "deployed") {
+		return fmt.Errorf("Error: release %s ended in status %q", p.Config.Release, info.Status)
+	}
+	return nil
+}
+
+// fetchReleaseStatus runs `helm status` for the configured release, since
+// some commands (e.g. `helm rollback`) don't support --output themselves.
+func fetchReleaseStatus(p *Plugin, stderr io.Writer) (*ReleaseInfo, error) {
+	args := []string{"status", p.Config.Release}
+	if isHelm3(p) {
+		args = append(args, "--output", "json")
+	}
+
+	output, err := runCommandOutput(p, args, stderr)
+	if err != nil {
+		return nil, err
+	}
+	return parseReleaseInfo(output)
+}
+
+// autoRollback reverts a failed upgrade to the previous known-good revision
+// (revision 0) so a broken release never reaches the cluster unattended.
+// The original upgrade error is always returned, even when the rollback
+// itself succeeds.
+func autoRollback(p *Plugin, cause error, stdout, stderr io.Writer) error {
+	upgradeErr := fmt.Errorf("Error running helm command: %s (%s)", strings.Join(p.Config.HelmCommand, " "), cause.Error())
+
+	log.Println("upgrade failed, rolling back release " + p.Config.Release)
+	rollback := rollbackArgs(p, "0")
+	if err := runCommand(p, rollback, stdout, stderr); err != nil {
+		return fmt.Errorf("%s (automatic rollback also failed: %s)", upgradeErr.Error(), err.Error())
+	}
+
+	return upgradeErr
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func stepKinds(steps []Step) []StepKind {
+	kinds := make([]StepKind, len(steps))
+	for i, s := range steps {
+		kinds[i] = s.Kind
+	}
+	return kinds
+}
+
+func TestNewPlan(t *testing.T) {
+	const missingKubeConfig = "/nonexistent/kubeconfig-for-tests"
+
+	cases := []struct {
+		name       string
+		cfg        Config
+		buildEvent string
+		wantKinds  []StepKind
+		wantErr    bool
+	}{
+		{
+			name:       "push event upgrades on helm2, bootstrapping kube and tiller",
+			cfg:        Config{KubeConfig: missingKubeConfig},
+			buildEvent: "push",
+			wantKinds:  []StepKind{StepInitKube, StepHelmInit, StepUpgrade},
+		},
+		{
+			name:       "helm3 skips helm init",
+			cfg:        Config{KubeConfig: missingKubeConfig, HelmVersion: "3"},
+			buildEvent: "push",
+			wantKinds:  []StepKind{StepInitKube, StepUpgrade},
+		},
+		{
+			name:       "explicit lint command wins over build event",
+			cfg:        Config{KubeConfig: missingKubeConfig, Command: "lint"},
+			buildEvent: "push",
+			wantKinds:  []StepKind{StepInitKube, StepHelmInit, StepLint},
+		},
+		{
+			name:       "delete build event",
+			cfg:        Config{KubeConfig: missingKubeConfig},
+			buildEvent: "delete",
+			wantKinds:  []StepKind{StepInitKube, StepHelmInit, StepDelete},
+		},
+		{
+			name:      "explicit rollback command",
+			cfg:       Config{KubeConfig: missingKubeConfig, Command: "rollback"},
+			wantKinds: []StepKind{StepInitKube, StepHelmInit, StepRollback},
+		},
+		{
+			name:    "unsupported helm_version is rejected",
+			cfg:     Config{KubeConfig: missingKubeConfig, HelmVersion: "4"},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported backend is rejected",
+			cfg:     Config{KubeConfig: missingKubeConfig, Backend: "rpc"},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("DRONE_BUILD_EVENT", c.buildEvent)
+
+			plan, err := NewPlan(c.cfg)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if got := stepKinds(plan.Steps); !reflect.DeepEqual(got, c.wantKinds) {
+				t.Errorf("got steps %v, want %v", got, c.wantKinds)
+			}
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -14,37 +16,46 @@ import (
 )
 
 var HELM_BIN = "/bin/helm"
+var HELM3_BIN = "/usr/bin/helm"
 var KUBECONFIG = "/root/.kube/kubeconfig"
 
 type (
 	// Config maps the params we need to run Helm
 	Config struct {
-		APIServer      string   `json:"api_server"`
-		Token          string   `json:"token"`
-		ServiceAccount string   `json:"service_account"`
-		KubeConfig     string   `json:"kube_config"`
-		HelmCommand    []string `json:"helm_command"`
-		SkipTLSVerify  bool     `json:"tls_skip_verify"`
-		Namespace      string   `json:"namespace"`
-		Release        string   `json:"release"`
-		Chart          string   `json:"chart"`
-		Version        string   `json:"version"`
-		Values         string   `json:"values"`
-		ValuesFiles    string   `json:"values_files"`
-		Debug          bool     `json:"debug"`
-		DryRun         bool     `json:"dry_run"`
-		Secrets        []string `json:"secrets"`
-		Prefix         string   `json:"prefix"`
-		TillerNs       string   `json:"tiller_ns"`
-		Wait           bool     `json:"wait"`
-		RecreatePods   bool     `json:"recreate_pods"`
-		Upgrade        bool     `json:"upgrade"`
-		CanaryImage    bool     `json:"canary_image"`
-		ClientOnly     bool     `json:"client_only"`
-		ReuseValues    bool     `json:"reuse_values"`
-		Timeout        string   `json:"timeout"`
-		Force          bool     `json:"force"`
-		HelmRepos      []string `json:"helm_repos"`
+		APIServer        string   `json:"api_server"`
+		Token            string   `json:"token"`
+		ServiceAccount   string   `json:"service_account"`
+		KubeConfig       string   `json:"kube_config"`
+		HelmCommand      []string `json:"helm_command"`
+		SkipTLSVerify    bool     `json:"tls_skip_verify"`
+		Namespace        string   `json:"namespace"`
+		Release          string   `json:"release"`
+		Chart            string   `json:"chart"`
+		Version          string   `json:"version"`
+		Values           string   `json:"values"`
+		ValuesFiles      string   `json:"values_files"`
+		Debug            bool     `json:"debug"`
+		DryRun           bool     `json:"dry_run"`
+		Secrets          []string `json:"secrets"`
+		Prefix           string   `json:"prefix"`
+		TillerNs         string   `json:"tiller_ns"`
+		Wait             bool     `json:"wait"`
+		RecreatePods     bool     `json:"recreate_pods"`
+		Upgrade          bool     `json:"upgrade"`
+		CanaryImage      bool     `json:"canary_image"`
+		ClientOnly       bool     `json:"client_only"`
+		ReuseValues      bool     `json:"reuse_values"`
+		Timeout          string   `json:"timeout"`
+		Force            bool     `json:"force"`
+		HelmRepos        []string `json:"helm_repos"`
+		HelmVersion      string   `json:"helm_version"`
+		Helm3Bin         string   `json:"helm3_bin"`
+		Command          string   `json:"command"`
+		Strict           bool     `json:"strict"`
+		Revision         string   `json:"revision"`
+		AutoRollback     bool     `json:"auto_rollback"`
+		StatusOutputFile string   `json:"status_output_file"`
+		Backend          string   `json:"backend"`
 	}
 	// Plugin default
 	Plugin struct {
@@ -52,6 +63,23 @@ type (
 	}
 )
 
+// isHelm3 reports whether the plugin is configured to target Helm 3.
+// Helm 2 remains the default so existing pipelines are unaffected.
+func isHelm3(p *Plugin) bool {
+	return p.Config.HelmVersion == "3"
+}
+
+// helmBin returns the helm binary to invoke for the configured Helm version.
+func helmBin(p *Plugin) string {
+	if isHelm3(p) {
+		if p.Config.Helm3Bin != "" {
+			return p.Config.Helm3Bin
+		}
+		return HELM3_BIN
+	}
+	return HELM_BIN
+}
+
 func setHelmHelp(p *Plugin) {
 	p.Config.HelmCommand = []string{""}
 }
@@ -90,7 +118,7 @@ func setPushEventCommand(p *Plugin) {
 		upgrade = append(upgrade, "--namespace")
 		upgrade = append(upgrade, p.Config.Namespace)
 	}
-	if p.Config.TillerNs != "" {
+	if p.Config.TillerNs != "" && !isHelm3(p) {
 		upgrade = append(upgrade, "--tiller-namespace")
 		upgrade = append(upgrade, p.Config.TillerNs)
 	}
@@ -104,7 +132,16 @@ func setPushEventCommand(p *Plugin) {
 		upgrade = append(upgrade, "--wait")
 	}
 	if p.Config.RecreatePods {
-		upgrade = append(upgrade, "--recreate-pods")
+		if isHelm3(p) {
+			// Helm 3 removed --recreate-pods with no equivalent flag; silently
+			// mapping it to something else (e.g. --cleanup-on-fail) would change
+			// behaviour the user didn't ask for, so just drop it.
+			if p.Config.Debug {
+				log.Println("recreate_pods is not supported on Helm 3; ignoring")
+			}
+		} else {
+			upgrade = append(upgrade, "--recreate-pods")
+		}
 	}
 	if p.Config.ReuseValues {
 		upgrade = append(upgrade, "--reuse-values")
@@ -116,32 +153,130 @@ func setPushEventCommand(p *Plugin) {
 	if p.Config.Force {
 		upgrade = append(upgrade, "--force")
 	}
+	if isHelm3(p) {
+		upgrade = append(upgrade, "--output", "json")
+	}
 	p.Config.HelmCommand = upgrade
 
 }
 
 func setHelmCommand(p *Plugin) {
-	buildEvent := os.Getenv("DRONE_BUILD_EVENT")
-	switch buildEvent {
-	case "push":
-		setPushEventCommand(p)
-	case "tag":
-		setPushEventCommand(p)
-	case "deployment":
+	switch helmAction(p) {
+	case "upgrade":
 		setPushEventCommand(p)
 	case "delete":
 		setDeleteEventCommand(p)
+	case "lint":
+		setLintCommand(p)
+	case "rollback":
+		setRollbackCommand(p)
 	default:
 		setHelmHelp(p)
 	}
 
 }
 
-var repoExp = regexp.MustCompile(`^(?P<name>[\w-]+)=(?P<url>(http|https)://[\w-./:]+)`)
+// rollbackArgs builds a `helm rollback <release> <revision>` invocation.
+func rollbackArgs(p *Plugin, revision string) []string {
+	rollback := make([]string, 3)
+	rollback[0] = "rollback"
+	rollback[1] = p.Config.Release
+	rollback[2] = revision
+
+	if p.Config.Wait {
+		rollback = append(rollback, "--wait")
+	}
+	if p.Config.Timeout != "" {
+		rollback = append(rollback, "--timeout")
+		rollback = append(rollback, p.Config.Timeout)
+	}
+	if p.Config.Force {
+		rollback = append(rollback, "--force")
+	}
+	if p.Config.RecreatePods {
+		if isHelm3(p) {
+			// Helm 3 removed --recreate-pods with no equivalent flag; drop it
+			// rather than silently substituting different behaviour.
+			if p.Config.Debug {
+				log.Println("recreate_pods is not supported on Helm 3; ignoring")
+			}
+		} else {
+			rollback = append(rollback, "--recreate-pods")
+		}
+	}
+
+	return rollback
+}
+
+// setRollbackCommand builds a `helm rollback` invocation for the release
+// and revision configured by the user, defaulting to revision 0 (the
+// previous release) when none is given.
+func setRollbackCommand(p *Plugin) {
+	revision := p.Config.Revision
+	if revision == "" {
+		revision = "0"
+	}
+	p.Config.HelmCommand = rollbackArgs(p, revision)
+}
+
+// helmAction resolves which helm action to run. An explicit `command`
+// setting always wins; otherwise it falls back to the DRONE_BUILD_EVENT
+// mapping used historically by this plugin.
+func helmAction(p *Plugin) string {
+	if p.Config.Command != "" {
+		return p.Config.Command
+	}
+
+	switch os.Getenv("DRONE_BUILD_EVENT") {
+	case "push", "tag", "deployment":
+		return "upgrade"
+	case "delete":
+		return "delete"
+	case "pull_request":
+		return "lint"
+	default:
+		return ""
+	}
+}
+
+// setLintCommand builds a `helm lint` invocation for the configured chart.
+func setLintCommand(p *Plugin) {
+	lint := make([]string, 2)
+	lint[0] = "lint"
+	lint[1] = p.Config.Chart
+
+	if p.Config.Values != "" {
+		lint = append(lint, "--set")
+		lint = append(lint, unQuote(p.Config.Values))
+	}
+	if p.Config.ValuesFiles != "" {
+		for _, valuesFile := range strings.Split(p.Config.ValuesFiles, ",") {
+			lint = append(lint, "--values")
+			lint = append(lint, valuesFile)
+		}
+	}
+	if p.Config.Namespace != "" {
+		lint = append(lint, "--namespace")
+		lint = append(lint, p.Config.Namespace)
+	}
+	if p.Config.Strict {
+		lint = append(lint, "--strict")
+	}
+
+	p.Config.HelmCommand = lint
+}
+
+var repoExp = regexp.MustCompile(`^(?P<name>[\w-]+)=(?P<url>(http|https)://[\w@%./:-]+)`)
 
-// parseRepo returns map of regex capture groups (name, url)
+// parseRepo returns a map of the repo's name and url, plus any optional
+// attributes (username, password, ca_file, cert_file, key_file) supplied
+// as trailing "key=value" pairs, e.g.:
+//
+//	myrepo=https://charts.example.com,username=$REPO_USER,password=$REPO_PASS
 func parseRepo(repo string) (map[string]string, error) {
-	matches := repoExp.FindStringSubmatch(repo)
+	parts := strings.Split(repo, ",")
+
+	matches := repoExp.FindStringSubmatch(parts[0])
 	if len(matches) < 1 {
 		return nil, fmt.Errorf("Invalid repo definition: %s", repo)
 	}
@@ -151,10 +286,24 @@ func parseRepo(repo string) (map[string]string, error) {
 			result[name] = matches[i]
 		}
 	}
+
+	for _, attr := range parts[1:] {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid repo attribute: %s", attr)
+		}
+		result[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
 	return result, nil
 }
 
-func doHelmRepoAdd(repo string) ([]string, error) {
+// doHelmRepoAdd builds a `helm repo add` invocation for repo, resolving
+// any $VAR-style username/password attributes against Drone secrets;
+// ca_file, cert_file and key_file are passed to helm as given.
+// Credentials may also be embedded directly in the URL, in which case
+// helm picks them up without any extra flags.
+func doHelmRepoAdd(repo string, p *Plugin) ([]string, error) {
 	repoMap, err := parseRepo(unQuote(repo))
 	if err != nil {
 		return nil, err
@@ -165,10 +314,33 @@ func doHelmRepoAdd(repo string) ([]string, error) {
 		repoMap["name"],
 		repoMap["url"],
 	}
+
+	if username := resolveEnvVar(repoMap["username"], p.Config.Prefix, p.Config.Debug); username != "" {
+		repoAdd = append(repoAdd, "--username", username)
+	}
+	if password := resolveEnvVar(repoMap["password"], p.Config.Prefix, p.Config.Debug); password != "" {
+		repoAdd = append(repoAdd, "--password", password)
+	}
+	if repoMap["ca_file"] != "" {
+		repoAdd = append(repoAdd, "--ca-file", repoMap["ca_file"])
+	}
+	if repoMap["cert_file"] != "" {
+		repoAdd = append(repoAdd, "--cert-file", repoMap["cert_file"])
+	}
+	if repoMap["key_file"] != "" {
+		repoAdd = append(repoAdd, "--key-file", repoMap["key_file"])
+	}
+
 	return repoAdd, nil
 }
 
+// doHelmInit builds the "helm init" command used to bootstrap Tiller.
+// Helm 3 has no Tiller and therefore no init step; it returns nil.
 func doHelmInit(p *Plugin) []string {
+	if isHelm3(p) {
+		return nil
+	}
+
 	init := make([]string, 1)
 	init[0] = "init"
 	if p.Config.TillerNs != "" {
@@ -195,58 +367,16 @@ func (p *Plugin) Exec() error {
 		p.debugEnv()
 	}
 
-	// create /root/.kube/config file if not exists
-	if _, err := os.Stat(p.Config.KubeConfig); os.IsNotExist(err) {
-		resolveSecrets(p)
-		if p.Config.APIServer == "" {
-			return fmt.Errorf("Error: API Server is needed to deploy.")
-		}
-		if p.Config.Token == "" {
-			return fmt.Errorf("Error: Token is needed to deploy.")
-		}
-
-		initialiseKubeconfig(&p.Config, KUBECONFIG, p.Config.KubeConfig)
-	}
-
-	if p.Config.Debug {
-		p.debug()
-	}
-
-	init := doHelmInit(p)
-	err := runCommand(init)
+	plan, err := NewPlan(p.Config)
 	if err != nil {
-		return fmt.Errorf("Error running helm command: " + strings.Join(init[:], " "))
-	}
-
-	if len(p.Config.HelmRepos) > 0 {
-		for _, repo := range p.Config.HelmRepos {
-			repoAdd, err := doHelmRepoAdd(repo)
-			if err == nil {
-				if p.Config.Debug {
-					log.Println("adding helm repo: " + strings.Join(repoAdd[:], " "))
-				}
-
-				if err = runCommand(repoAdd); err != nil {
-					return fmt.Errorf("Error adding helm repo: " + err.Error())
-				}
-			} else {
-				return err
-			}
-		}
+		return err
 	}
 
-	setHelmCommand(p)
-
 	if p.Config.Debug {
-		log.Println("helm command: " + strings.Join(p.Config.HelmCommand[:], " "))
-	}
-
-	err = runCommand(p.Config.HelmCommand)
-	if err != nil {
-		return fmt.Errorf("Error running helm command: " + strings.Join(p.Config.HelmCommand[:], " "))
+		p.debug()
 	}
 
-	return nil
+	return plan.Execute(os.Stdout, os.Stderr)
 }
 
 func initialiseKubeconfig(params *Config, source string, target string) error {
@@ -261,17 +391,45 @@ func initialiseKubeconfig(params *Config, source string, target string) error {
 	return t.Execute(f, params)
 }
 
-func runCommand(params []string) error {
+func runCommand(p *Plugin, params []string, stdout, stderr io.Writer) error {
 	cmd := new(exec.Cmd)
-	cmd = exec.Command(HELM_BIN, params...)
+	cmd = exec.Command(helmBin(p), params...)
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
 	err := cmd.Run()
 	return err
 }
 
+// runCommandCapture behaves like runCommand but also tees helm's stdout
+// into a buffer, so callers that need to parse the release output (e.g.
+// --output json) don't have to give up streaming it to the caller.
+func runCommandCapture(p *Plugin, params []string, stdout, stderr io.Writer) ([]byte, error) {
+	var buf bytes.Buffer
+	cmd := exec.Command(helmBin(p), params...)
+
+	cmd.Stdout = io.MultiWriter(stdout, &buf)
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	return buf.Bytes(), err
+}
+
+// runCommandOutput runs a helm command and returns its stdout without
+// forwarding it anywhere else, for auxiliary lookups (e.g. `helm status`)
+// whose output isn't part of the pipeline's visible log.
+func runCommandOutput(p *Plugin, params []string, stderr io.Writer) ([]byte, error) {
+	var buf bytes.Buffer
+	cmd := exec.Command(helmBin(p), params...)
+
+	cmd.Stdout = &buf
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	return buf.Bytes(), err
+}
+
 func resolveSecrets(p *Plugin) {
 	p.Config.Values = resolveEnvVar(p.Config.Values, p.Config.Prefix, p.Config.Debug)
 	p.Config.APIServer = resolveEnvVar("${API_SERVER}", p.Config.Prefix, p.Config.Debug)
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetPushEventCommand(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+		want []string
+	}{
+		{
+			name: "helm2 minimal",
+			cfg:  Config{Chart: "./chart"},
+			want: []string{"upgrade", "--install", "./chart"},
+		},
+		{
+			name: "helm2 with release and namespace",
+			cfg:  Config{Release: "myrelease", Chart: "./chart", Namespace: "prod"},
+			want: []string{"upgrade", "--install", "myrelease", "./chart", "--namespace", "prod"},
+		},
+		{
+			name: "helm3 drops tiller-namespace and appends --output json",
+			cfg:  Config{Chart: "./chart", HelmVersion: "3", TillerNs: "tiller-system"},
+			want: []string{"upgrade", "--install", "./chart", "--output", "json"},
+		},
+		{
+			name: "helm3 drops recreate_pods instead of rewriting it",
+			cfg:  Config{Chart: "./chart", HelmVersion: "3", RecreatePods: true},
+			want: []string{"upgrade", "--install", "./chart", "--output", "json"},
+		},
+		{
+			name: "helm2 keeps recreate_pods as --recreate-pods",
+			cfg:  Config{Chart: "./chart", RecreatePods: true},
+			want: []string{"upgrade", "--install", "./chart", "--recreate-pods"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := &Plugin{Config: c.cfg}
+			setPushEventCommand(p)
+			if !reflect.DeepEqual(p.Config.HelmCommand, c.want) {
+				t.Errorf("got %v, want %v", p.Config.HelmCommand, c.want)
+			}
+		})
+	}
+}
+
+func TestSetRollbackCommand(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+		want []string
+	}{
+		{
+			name: "defaults to revision 0",
+			cfg:  Config{Release: "myrelease"},
+			want: []string{"rollback", "myrelease", "0"},
+		},
+		{
+			name: "explicit revision",
+			cfg:  Config{Release: "myrelease", Revision: "3"},
+			want: []string{"rollback", "myrelease", "3"},
+		},
+		{
+			name: "helm3 never gets --output (helm rollback has no such flag)",
+			cfg:  Config{Release: "myrelease", HelmVersion: "3", Wait: true},
+			want: []string{"rollback", "myrelease", "0", "--wait"},
+		},
+		{
+			name: "helm3 drops recreate_pods instead of rewriting it",
+			cfg:  Config{Release: "myrelease", HelmVersion: "3", RecreatePods: true},
+			want: []string{"rollback", "myrelease", "0"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := &Plugin{Config: c.cfg}
+			setRollbackCommand(p)
+			if !reflect.DeepEqual(p.Config.HelmCommand, c.want) {
+				t.Errorf("got %v, want %v", p.Config.HelmCommand, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+// statusExp matches the "STATUS: DEPLOYED" line Helm 2 prints in its
+// plain-text install/upgrade/status output.
+var statusExp = regexp.MustCompile(`(?m)^STATUS:\s*(\S+)`)
+
+// ReleaseInfo is the plugin's stable view of a helm release, parsed out
+// of `--output json` (Helm 3) or, failing that, scraped from helm's
+// plain-text status output (Helm 2).
+type ReleaseInfo struct {
+	Name          string `json:"name"`
+	Namespace     string `json:"namespace"`
+	Revision      int    `json:"revision"`
+	Status        string `json:"status"`
+	Description   string `json:"description"`
+	Notes         string `json:"notes"`
+	FirstDeployed string `json:"first_deployed"`
+	LastDeployed  string `json:"last_deployed"`
+}
+
+// helmReleaseJSON mirrors the shape helm itself emits for
+// install/upgrade/status --output json.
+type helmReleaseJSON struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Version   int    `json:"version"`
+	Info      struct {
+		Status        string `json:"status"`
+		Description   string `json:"description"`
+		Notes         string `json:"notes"`
+		FirstDeployed string `json:"first_deployed"`
+		LastDeployed  string `json:"last_deployed"`
+	} `json:"info"`
+}
+
+// parseReleaseInfo turns helm's output into a ReleaseInfo. It first tries
+// --output json (Helm 3); if that fails to parse, it falls back to
+// scraping the "STATUS:" line Helm 2 prints as plain text.
+func parseReleaseInfo(output []byte) (*ReleaseInfo, error) {
+	var parsed helmReleaseJSON
+	if err := json.Unmarshal(output, &parsed); err == nil && parsed.Name != "" {
+		return &ReleaseInfo{
+			Name:          parsed.Name,
+			Namespace:     parsed.Namespace,
+			Revision:      parsed.Version,
+			Status:        parsed.Info.Status,
+			Description:   parsed.Info.Description,
+			Notes:         parsed.Info.Notes,
+			FirstDeployed: parsed.Info.FirstDeployed,
+			LastDeployed:  parsed.Info.LastDeployed,
+		}, nil
+	}
+
+	if status := statusExp.FindSubmatch(output); status != nil {
+		return &ReleaseInfo{Status: string(status[1])}, nil
+	}
+
+	return nil, fmt.Errorf("Error: could not parse helm release output")
+}
+
+// writeReleaseInfo logs info and, when path is set, writes it as JSON so
+// downstream Drone steps can consume the release's final status.
+func writeReleaseInfo(path string, info *ReleaseInfo) error {
+	fmt.Printf("release %s: status=%s revision=%d\n", info.Name, info.Status, info.Revision)
+
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
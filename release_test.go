@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestParseReleaseInfo(t *testing.T) {
+	cases := []struct {
+		name       string
+		output     string
+		wantStatus string
+		wantErr    bool
+	}{
+		{
+			name:       "helm3 --output json",
+			output:     `{"name":"myrelease","namespace":"default","version":2,"info":{"status":"deployed","description":"Upgrade complete","notes":"","first_deployed":"2026-01-01T00:00:00Z","last_deployed":"2026-01-02T00:00:00Z"}}`,
+			wantStatus: "deployed",
+		},
+		{
+			name:       "helm2 plain text fallback reports its own uppercase status",
+			output:     "LAST DEPLOYED: Mon Jan  1 00:00:00 2026\nNAMESPACE: default\nSTATUS: DEPLOYED\n\nNOTES:\n",
+			wantStatus: "DEPLOYED",
+		},
+		{
+			name:    "unparseable output",
+			output:  "not helm output at all",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			info, err := parseReleaseInfo([]byte(c.output))
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if info.Status != c.wantStatus {
+				t.Errorf("got status %q, want %q", info.Status, c.wantStatus)
+			}
+		})
+	}
+}
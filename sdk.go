@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/repo"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"helm.sh/helm/v3/pkg/strvals"
+	"sigs.k8s.io/yaml"
+)
+
+// isSDKBackend reports whether the plugin should drive helm through the
+// embedded Helm Go SDK (helm.sh/helm/v3/pkg/action) instead of shelling
+// out to a helm binary. The SDK backend targets Helm 3 release semantics
+// only and does not depend on a helm binary being present in the image.
+func isSDKBackend(p *Plugin) bool {
+	return p.Config.Backend == "sdk"
+}
+
+// newActionConfiguration wires up an action.Configuration against the
+// cluster described by the plugin's kubeconfig, logging through debugf
+// when debug is enabled.
+func newActionConfiguration(p *Plugin) (*action.Configuration, error) {
+	settings := cli.New()
+	settings.KubeConfig = p.Config.KubeConfig
+
+	debugf := func(format string, v ...interface{}) {
+		if p.Config.Debug {
+			fmt.Printf(format+"\n", v...)
+		}
+	}
+
+	actionConfig := new(action.Configuration)
+	if err := actionConfig.Init(settings.RESTClientGetter(), p.Config.Namespace, "secrets", debugf); err != nil {
+		return nil, err
+	}
+	return actionConfig, nil
+}
+
+// sdkValues merges values_files and --set overrides the same way the helm
+// CLI does: later files and --set entries win over earlier ones.
+func sdkValues(p *Plugin) (map[string]interface{}, error) {
+	base := map[string]interface{}{}
+
+	if p.Config.ValuesFiles != "" {
+		for _, valuesFile := range strings.Split(p.Config.ValuesFiles, ",") {
+			raw, err := ioutil.ReadFile(valuesFile)
+			if err != nil {
+				return nil, err
+			}
+			var fileValues map[string]interface{}
+			if err := yaml.Unmarshal(raw, &fileValues); err != nil {
+				return nil, fmt.Errorf("Error parsing %s: %s", valuesFile, err.Error())
+			}
+			base = chartutil.CoalesceTables(fileValues, base)
+		}
+	}
+
+	if p.Config.Values != "" {
+		overrides := map[string]interface{}{}
+		if err := strvals.ParseInto(unQuote(p.Config.Values), overrides); err != nil {
+			return nil, fmt.Errorf("Error parsing --set values: %s", err.Error())
+		}
+		base = chartutil.CoalesceTables(overrides, base)
+	}
+
+	return base, nil
+}
+
+// sdkTimeout parses Config.Timeout (e.g. "5m0s") for SDK calls that take a
+// time.Duration rather than helm's CLI-flavoured timeout string.
+func sdkTimeout(p *Plugin) time.Duration {
+	if p.Config.Timeout == "" {
+		return 5 * time.Minute
+	}
+	d, err := time.ParseDuration(p.Config.Timeout)
+	if err != nil {
+		return 5 * time.Minute
+	}
+	return d
+}
+
+// releaseResult adapts helm's own *release.Release into this plugin's
+// ReleaseInfo, the same struct the exec backend parses from --output json.
+type releaseResult struct {
+	rel *release.Release
+}
+
+func toReleaseResult(r *release.Release) *releaseResult {
+	return &releaseResult{rel: r}
+}
+
+func (r *releaseResult) info() *ReleaseInfo {
+	info := &ReleaseInfo{
+		Name:      r.rel.Name,
+		Namespace: r.rel.Namespace,
+		Revision:  r.rel.Version,
+	}
+	if r.rel.Info != nil {
+		info.Status = r.rel.Info.Status.String()
+		info.Description = r.rel.Info.Description
+		info.Notes = r.rel.Info.Notes
+		if !r.rel.Info.FirstDeployed.IsZero() {
+			info.FirstDeployed = r.rel.Info.FirstDeployed.String()
+		}
+		if !r.rel.Info.LastDeployed.IsZero() {
+			info.LastDeployed = r.rel.Info.LastDeployed.String()
+		}
+	}
+	return info
+}
+
+// getterProviders returns the schemes (http, https, oci, ...) the SDK
+// backend can fetch chart repository indexes over.
+func getterProviders() getter.Providers {
+	return getter.All(cli.New())
+}
+
+// sdkUpgrade installs or upgrades the configured release using the Helm
+// SDK directly, with cancellation via ctx, instead of exec.Command.
+func sdkUpgrade(ctx context.Context, p *Plugin) (*ReleaseInfo, error) {
+	actionConfig, err := newActionConfiguration(p)
+	if err != nil {
+		return nil, err
+	}
+
+	chart, err := loader.Load(p.Config.Chart)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := sdkValues(p)
+	if err != nil {
+		return nil, err
+	}
+
+	_, histErr := action.NewHistory(actionConfig).Run(p.Config.Release)
+
+	var rel *releaseResult
+	if histErr == driver.ErrReleaseNotFound {
+		install := action.NewInstall(actionConfig)
+		install.ReleaseName = p.Config.Release
+		install.Namespace = p.Config.Namespace
+		install.Wait = p.Config.Wait
+		install.Timeout = sdkTimeout(p)
+
+		r, err := install.RunWithContext(ctx, chart, values)
+		if err != nil {
+			return nil, err
+		}
+		rel = toReleaseResult(r)
+	} else {
+		upgrade := action.NewUpgrade(actionConfig)
+		upgrade.Namespace = p.Config.Namespace
+		upgrade.Wait = p.Config.Wait
+		upgrade.Force = p.Config.Force
+		upgrade.ReuseValues = p.Config.ReuseValues
+		upgrade.Timeout = sdkTimeout(p)
+
+		r, err := upgrade.RunWithContext(ctx, p.Config.Release, chart, values)
+		if err != nil {
+			return nil, err
+		}
+		rel = toReleaseResult(r)
+	}
+
+	return rel.info(), nil
+}
+
+// sdkRollback rolls the configured release back to revision via the SDK.
+func sdkRollback(p *Plugin, revision int) (*ReleaseInfo, error) {
+	actionConfig, err := newActionConfiguration(p)
+	if err != nil {
+		return nil, err
+	}
+
+	rollback := action.NewRollback(actionConfig)
+	rollback.Version = revision
+	rollback.Wait = p.Config.Wait
+	rollback.Force = p.Config.Force
+	rollback.Timeout = sdkTimeout(p)
+
+	if err := rollback.Run(p.Config.Release); err != nil {
+		return nil, err
+	}
+
+	history, err := action.NewHistory(actionConfig).Run(p.Config.Release)
+	if err != nil || len(history) == 0 {
+		return &ReleaseInfo{Name: p.Config.Release, Status: "deployed"}, nil
+	}
+	return toReleaseResult(history[len(history)-1]).info(), nil
+}
+
+// sdkDelete uninstalls the configured release via the SDK.
+func sdkDelete(p *Plugin) error {
+	actionConfig, err := newActionConfiguration(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = action.NewUninstall(actionConfig).Run(p.Config.Release)
+	return err
+}
+
+// sdkLint lints the configured chart via the SDK and returns an error
+// describing every failing message, mirroring `helm lint`'s own summary.
+func sdkLint(p *Plugin) error {
+	values, err := sdkValues(p)
+	if err != nil {
+		return err
+	}
+
+	lint := action.NewLint()
+	lint.Strict = p.Config.Strict
+	lint.Namespace = p.Config.Namespace
+
+	result := lint.Run([]string{p.Config.Chart}, values)
+	if len(result.Errors) == 0 {
+		return nil
+	}
+
+	messages := make([]string, 0, len(result.Errors))
+	for _, err := range result.Errors {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Errorf("Error: helm lint failed: %s", strings.Join(messages, "; "))
+}
+
+// sdkAddRepo adds repo to the user's repository file via the SDK rather
+// than shelling out to `helm repo add`.
+func sdkAddRepo(p *Plugin, repoStr string) error {
+	repoMap, err := parseRepo(unQuote(repoStr))
+	if err != nil {
+		return err
+	}
+
+	settings := cli.New()
+
+	repoFile, err := repo.LoadFile(settings.RepositoryConfig)
+	if err != nil {
+		repoFile = repo.NewFile()
+	}
+
+	entry := &repo.Entry{
+		Name:     repoMap["name"],
+		URL:      repoMap["url"],
+		Username: resolveEnvVar(repoMap["username"], p.Config.Prefix, p.Config.Debug),
+		Password: resolveEnvVar(repoMap["password"], p.Config.Prefix, p.Config.Debug),
+		CAFile:   repoMap["ca_file"],
+		CertFile: repoMap["cert_file"],
+		KeyFile:  repoMap["key_file"],
+	}
+
+	chartRepo, err := repo.NewChartRepository(entry, getterProviders())
+	if err != nil {
+		return err
+	}
+	if _, err := chartRepo.DownloadIndexFile(); err != nil {
+		return fmt.Errorf("Error: could not reach repo %s: %s", entry.Name, err.Error())
+	}
+
+	repoFile.Update(entry)
+	return repoFile.WriteFile(settings.RepositoryConfig, 0644)
+}
+
+// writeSDKStatus is the SDK-backend counterpart of the exec backend's
+// runUpgradeStep: it logs and persists a ReleaseInfo the same way.
+func writeSDKStatus(p *Plugin, info *ReleaseInfo, stdout io.Writer) error {
+	fmt.Fprintf(stdout, "release %s: status=%s revision=%d\n", info.Name, info.Status, info.Revision)
+	return writeReleaseInfo(p.Config.StatusOutputFile, info)
+}